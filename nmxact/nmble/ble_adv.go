@@ -0,0 +1,383 @@
+package nmble
+
+import (
+	"encoding/json"
+)
+
+// New BLE_GAP message types used by the peripheral (advertising) surface.
+// These continue the MSG_TYPE_* sequence started in ble_dispatch.go rather
+// than picking an arbitrary base of their own.
+const (
+	MSG_TYPE_ADV_SET_FIELDS = MSG_TYPE_SYNC_EVT + 1 + iota
+	MSG_TYPE_ADV_START
+	MSG_TYPE_ADV_STOP
+	MSG_TYPE_ADV_EVT
+)
+
+// bleAdvRsp is the generic ack blehostd sends back for
+// MSG_TYPE_ADV_SET_FIELDS/START/STOP; none of those carry any data beyond
+// a status, so one struct decodes all three.
+type bleAdvRsp struct {
+	Op     int   `json:"op"`
+	Type   int   `json:"type"`
+	Seq    int   `json:"seq"`
+	Status uint8 `json:"status"`
+}
+
+func init() {
+	RegisterBleMsgType(MSG_OP_RSP, MSG_TYPE_ADV_SET_FIELDS,
+		func() BleMsg { return &bleAdvRsp{} })
+	RegisterBleMsgType(MSG_OP_RSP, MSG_TYPE_ADV_START,
+		func() BleMsg { return &bleAdvRsp{} })
+	RegisterBleMsgType(MSG_OP_RSP, MSG_TYPE_ADV_STOP,
+		func() BleMsg { return &bleAdvRsp{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_ADV_EVT,
+		func() BleMsg { return &BleAdvEvt{} })
+}
+
+type BleAdvConnMode int
+
+const (
+	BLE_ADV_CONN_MODE_NON BleAdvConnMode = iota
+	BLE_ADV_CONN_MODE_DIR
+	BLE_ADV_CONN_MODE_UND
+)
+
+type BleAdvDiscMode int
+
+const (
+	BLE_ADV_DISC_MODE_NON BleAdvDiscMode = iota
+	BLE_ADV_DISC_MODE_LTD
+	BLE_ADV_DISC_MODE_GEN
+)
+
+type BleAddrType int
+
+const (
+	BLE_ADDR_TYPE_PUBLIC BleAddrType = iota
+	BLE_ADDR_TYPE_RANDOM
+	BLE_ADDR_TYPE_RPA_PUB
+	BLE_ADDR_TYPE_RPA_RND
+)
+
+type BleAdvFilterPolicy int
+
+const (
+	BLE_ADV_FILT_NONE BleAdvFilterPolicy = iota
+	BLE_ADV_FILT_SCAN
+	BLE_ADV_FILT_CONN
+	BLE_ADV_FILT_BOTH
+)
+
+type BleAddr struct {
+	Type  BleAddrType `json:"type"`
+	Bytes [6]byte     `json:"bytes"`
+}
+
+// BleAdvFields specifies the contents of an advertisement or scan-response
+// payload.  The Has* companions mark whether Flags, TxPwrLvl and Appearance
+// are present; those three values are encoded whether or not their flag is
+// set.  The UUID lists, name and data fields are left out of the JSON when
+// empty, and the *IsComplete companions mark whether a UUID list or the name
+// is the complete or the incomplete form.
+type BleAdvFields struct {
+	HasFlags bool  `json:"has_flags"`
+	Flags    uint8 `json:"flags"`
+
+	Uuids16           []uint16 `json:"uuids16,omitempty"`
+	Uuids16IsComplete bool     `json:"uuids16_is_complete"`
+
+	Uuids32           []uint32 `json:"uuids32,omitempty"`
+	Uuids32IsComplete bool     `json:"uuids32_is_complete"`
+
+	Uuids128           [][16]byte `json:"uuids128,omitempty"`
+	Uuids128IsComplete bool       `json:"uuids128_is_complete"`
+
+	Name           string `json:"name,omitempty"`
+	NameIsComplete bool   `json:"name_is_complete"`
+
+	HasTxPwrLvl bool  `json:"has_tx_pwr_lvl"`
+	TxPwrLvl    int8  `json:"tx_pwr_lvl"`
+
+	HasAppearance bool   `json:"has_appearance"`
+	Appearance    uint16 `json:"appearance"`
+
+	MfgData []byte `json:"mfg_data,omitempty"`
+
+	SvcDataUuid16  []byte `json:"svc_data_uuid16,omitempty"`
+	SvcDataUuid32  []byte `json:"svc_data_uuid32,omitempty"`
+	SvcDataUuid128 []byte `json:"svc_data_uuid128,omitempty"`
+}
+
+// BleAdvParams specifies how a peripheral advertises: the GAP connectable
+// and discoverable modes, the advertising interval, and which peers are
+// allowed to scan or connect.
+type BleAdvParams struct {
+	ConnMode BleAdvConnMode `json:"conn_mode"`
+	DiscMode BleAdvDiscMode `json:"disc_mode"`
+
+	ItvlMin uint16 `json:"itvl_min"`
+	ItvlMax uint16 `json:"itvl_max"`
+
+	OwnAddrType BleAddrType `json:"own_addr_type"`
+	PeerAddr    *BleAddr    `json:"peer_addr,omitempty"`
+
+	FilterPolicy BleAdvFilterPolicy `json:"filter_policy"`
+}
+
+func NewBleAdvParams() BleAdvParams {
+	return BleAdvParams{
+		ConnMode:     BLE_ADV_CONN_MODE_UND,
+		DiscMode:     BLE_ADV_DISC_MODE_GEN,
+		OwnAddrType:  BLE_ADDR_TYPE_PUBLIC,
+		FilterPolicy: BLE_ADV_FILT_NONE,
+	}
+}
+
+type bleAdvSetFieldsReq struct {
+	Op      int          `json:"op"`
+	Type    int          `json:"type"`
+	Seq     int          `json:"seq"`
+	ScanRsp bool         `json:"scan_rsp"`
+	Fields  BleAdvFields `json:"fields"`
+}
+
+type bleAdvStartReq struct {
+	Op     int          `json:"op"`
+	Type   int          `json:"type"`
+	Seq    int          `json:"seq"`
+	Params BleAdvParams `json:"params"`
+}
+
+type bleAdvStopReq struct {
+	Op   int `json:"op"`
+	Type int `json:"type"`
+	Seq  int `json:"seq"`
+}
+
+// BleAdvEvt reports a change in advertising state, e.g. a central
+// connecting to us or our advertisement timing out.
+type BleAdvEvt struct {
+	ConnHandle int  `json:"conn_handle"`
+	Connected  bool `json:"connected"`
+}
+
+// Advertiser drives blehostd's peripheral role: it configures the
+// advertisement and scan-response payloads, starts/stops advertising, and
+// reports connection events to its owner.
+type Advertiser struct {
+	bx      *BleXport
+	fields  BleAdvFields
+	scanRsp *BleAdvFields
+	params  BleAdvParams
+
+	bl      *BleListener
+	evtChan chan BleAdvEvt
+}
+
+// NewAdvertiser constructs an Advertiser.  scanRsp may be nil if no
+// scan-response payload is needed.
+func NewAdvertiser(bx *BleXport, fields BleAdvFields, scanRsp *BleAdvFields,
+	params BleAdvParams) *Advertiser {
+
+	return &Advertiser{
+		bx:      bx,
+		fields:  fields,
+		scanRsp: scanRsp,
+		params:  params,
+	}
+}
+
+func (a *Advertiser) setFields(fields BleAdvFields, scanRsp bool) error {
+	req := &bleAdvSetFieldsReq{
+		Op:      MSG_OP_REQ,
+		Type:    MSG_TYPE_ADV_SET_FIELDS,
+		Seq:     NextSeq(),
+		ScanRsp: scanRsp,
+		Fields:  fields,
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	bl := NewBleListener()
+	base := BleMsgBase{Op: -1, Type: -1, Seq: req.Seq, ConnHandle: -1}
+	if err := a.bx.Bd.AddListener(base, bl); err != nil {
+		return err
+	}
+	defer a.bx.Bd.RemoveListener(base)
+
+	if err := a.bx.Tx(j); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-bl.ErrChan:
+		return err
+	case <-bl.BleChan:
+		return nil
+	}
+}
+
+// Start configures the advertisement payload(s) and begins advertising.  It
+// registers an internal listener for connection events; use Evts() to
+// receive them.
+func (a *Advertiser) Start() error {
+	if err := a.setFields(a.fields, false); err != nil {
+		return err
+	}
+	if a.scanRsp != nil {
+		if err := a.setFields(*a.scanRsp, true); err != nil {
+			return err
+		}
+	}
+
+	bl := NewBleListener()
+	base := BleMsgBase{
+		Op:         MSG_OP_EVT,
+		Type:       MSG_TYPE_ADV_EVT,
+		Seq:        -1,
+		ConnHandle: -1,
+	}
+	if err := a.bx.Bd.AddListener(base, bl); err != nil {
+		return err
+	}
+	a.bl = bl
+	a.evtChan = make(chan BleAdvEvt, 4)
+	go a.serveEvts(bl, a.evtChan)
+
+	req := &bleAdvStartReq{
+		Op:     MSG_OP_REQ,
+		Type:   MSG_TYPE_ADV_START,
+		Seq:    NextSeq(),
+		Params: a.params,
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		a.abortEvts(base, err)
+		return err
+	}
+
+	rspBl := NewBleListener()
+	rspBase := BleMsgBase{Op: -1, Type: -1, Seq: req.Seq, ConnHandle: -1}
+	if err := a.bx.Bd.AddListener(rspBase, rspBl); err != nil {
+		a.abortEvts(base, err)
+		return err
+	}
+	defer a.bx.Bd.RemoveListener(rspBase)
+
+	if err := a.bx.Tx(j); err != nil {
+		a.abortEvts(base, err)
+		return err
+	}
+
+	select {
+	case err := <-rspBl.ErrChan:
+		a.abortEvts(base, err)
+		return err
+	case <-rspBl.BleChan:
+		return nil
+	}
+}
+
+// abortEvts unregisters the connection-event listener and unblocks
+// serveEvts with err, for use on a Start() failure path after the listener
+// has already been registered.
+func (a *Advertiser) abortEvts(base BleMsgBase, err error) {
+	select {
+	case a.bl.ErrChan <- err:
+	default:
+	}
+	a.bx.Bd.RemoveListener(base)
+}
+
+// Stop halts advertising.  It is a no-op if advertising was never started.
+func (a *Advertiser) Stop() error {
+	if a.bl == nil {
+		return nil
+	}
+
+	base := BleMsgBase{
+		Op:         MSG_OP_EVT,
+		Type:       MSG_TYPE_ADV_EVT,
+		Seq:        -1,
+		ConnHandle: -1,
+	}
+	select {
+	case a.bl.ErrChan <- nil:
+	default:
+	}
+	defer a.bx.Bd.RemoveListener(base)
+	a.bl = nil
+
+	req := &bleAdvStopReq{
+		Op:   MSG_OP_REQ,
+		Type: MSG_TYPE_ADV_STOP,
+		Seq:  NextSeq(),
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	bl := NewBleListener()
+	rspBase := BleMsgBase{Op: -1, Type: -1, Seq: req.Seq, ConnHandle: -1}
+	if err := a.bx.Bd.AddListener(rspBase, bl); err != nil {
+		return err
+	}
+	defer a.bx.Bd.RemoveListener(rspBase)
+
+	if err := a.bx.Tx(j); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-bl.ErrChan:
+		return err
+	case <-bl.BleChan:
+		return nil
+	}
+}
+
+// serveEvts decodes raw BleAdvEvt messages off the dispatcher-fed listener
+// channel and republishes them on evtChan, closing it once the listener is
+// torn down (Stop(), a Start() failure, or transport shutdown).
+func (a *Advertiser) serveEvts(bl *BleListener, evtChan chan BleAdvEvt) {
+	defer close(evtChan)
+
+	for {
+		select {
+		case _, ok := <-bl.ErrChan:
+			if !ok {
+				return
+			}
+			return
+
+		case bm, ok := <-bl.BleChan:
+			if !ok {
+				return
+			}
+
+			evt, ok := bm.(*BleAdvEvt)
+			if !ok {
+				continue
+			}
+
+			select {
+			case evtChan <- *evt:
+			default:
+			}
+		}
+	}
+}
+
+// Evts returns the channel of connection events reported while advertising
+// is active.  It is only valid after a successful call to Start(), and is
+// closed once advertising stops.
+func (a *Advertiser) Evts() <-chan BleAdvEvt {
+	return a.evtChan
+}
@@ -0,0 +1,263 @@
+package nmble
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// BleMsg is the common type of every message a BleDispatcher decodes and
+// hands to a listener: *BleSyncRsp, *BleSyncEvt, *bleGattAccessEvt,
+// *BleAdvEvt, and so on.
+type BleMsg interface{}
+
+// BleMsgBase holds the fields blehostd's JSON protocol uses to route a
+// message: Seq identifies the request a response answers, ConnHandle scopes
+// a message to one connection, and Op+Type together select the listener
+// registered for an unsolicited event.  AddListener/RemoveListener take a
+// BleMsgBase with -1 in any field the caller doesn't want to match on.
+type BleMsgBase struct {
+	Op         int `json:"op"`
+	Type       int `json:"type"`
+	Seq        int `json:"seq"`
+	ConnHandle int `json:"conn_handle"`
+}
+
+const (
+	MSG_OP_REQ = 0
+	MSG_OP_RSP = 1
+	MSG_OP_EVT = 2
+)
+
+// MSG_TYPE_SYNC(_EVT) are the central-role message types already in use
+// before the GAP (ble_adv.go) and GATT server (ble_gatt_svr.go) additions.
+// Those files continue this same sequence rather than picking arbitrary
+// bases of their own, so that central, GAP, and GATT message types can
+// never collide.
+const (
+	MSG_TYPE_SYNC = iota
+	MSG_TYPE_SYNC_EVT
+)
+
+type BleSyncReq struct {
+	Op   int `json:"op"`
+	Type int `json:"type"`
+	Seq  int `json:"seq"`
+}
+
+type BleSyncRsp struct {
+	Op     int  `json:"op"`
+	Type   int  `json:"type"`
+	Seq    int  `json:"seq"`
+	Synced bool `json:"synced"`
+}
+
+type BleSyncEvt struct {
+	Op     int  `json:"op"`
+	Type   int  `json:"type"`
+	Synced bool `json:"synced"`
+}
+
+func init() {
+	RegisterBleMsgType(MSG_OP_RSP, MSG_TYPE_SYNC,
+		func() BleMsg { return &BleSyncRsp{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_SYNC_EVT,
+		func() BleMsg { return &BleSyncEvt{} })
+}
+
+// seqCounter backs NextSeq().  It starts at 0 and NextSeq increments it
+// before use, so the first sequence number handed out is 1.
+var seqCounter uint32
+
+// NextSeq returns a sequence number suitable for a new outgoing request,
+// unique for the lifetime of the process.
+func NextSeq() int {
+	return int(atomic.AddUint32(&seqCounter, 1))
+}
+
+type bleMsgCtor func() BleMsg
+
+type bleMsgKey struct {
+	op  int
+	typ int
+}
+
+var bleMsgRegistryMtx sync.Mutex
+var bleMsgRegistry = map[bleMsgKey]bleMsgCtor{}
+
+// RegisterBleMsgType tells every BleDispatcher how to decode an incoming
+// message with the given op and type: ctor must return a fresh pointer to
+// decode the message body into.  Each file that introduces new wire
+// messages (this one, ble_adv.go, ble_gatt_svr.go) registers its types from
+// an init() function.
+func RegisterBleMsgType(op, typ int, ctor bleMsgCtor) {
+	bleMsgRegistryMtx.Lock()
+	defer bleMsgRegistryMtx.Unlock()
+
+	bleMsgRegistry[bleMsgKey{op: op, typ: typ}] = ctor
+}
+
+func lookupBleMsgCtor(op, typ int) bleMsgCtor {
+	bleMsgRegistryMtx.Lock()
+	defer bleMsgRegistryMtx.Unlock()
+
+	return bleMsgRegistry[bleMsgKey{op: op, typ: typ}]
+}
+
+// BleListener receives messages and errors matching a single BleMsgBase
+// filter registered with a BleDispatcher via AddListener.
+type BleListener struct {
+	BleChan chan BleMsg
+	ErrChan chan error
+}
+
+// NewBleListener constructs a BleListener.  BleChan is buffered so that a
+// short burst of messages is held for the listener while it catches up;
+// BleDispatcher.Dispatch never blocks, and drops a message once the channel
+// is full.
+func NewBleListener() *BleListener {
+	return &BleListener{
+		BleChan: make(chan BleMsg, 4),
+		ErrChan: make(chan error, 1),
+	}
+}
+
+type bleListenerEntry struct {
+	base BleMsgBase
+	bl   *BleListener
+}
+
+// BleDispatcher decodes JSON frames received from blehostd and routes each
+// one to whichever listeners were registered for its op/type/seq/conn
+// handle.  One BleDispatcher is created per BleXport and is cleared and
+// rebuilt on every restart.
+type BleDispatcher struct {
+	mtx       sync.Mutex
+	listeners []bleListenerEntry
+}
+
+func NewBleDispatcher() *BleDispatcher {
+	return &BleDispatcher{}
+}
+
+// AddListener registers bl to receive messages matching base.  A field set
+// to -1 matches any value.
+func (bd *BleDispatcher) AddListener(base BleMsgBase, bl *BleListener) error {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	bd.listeners = append(bd.listeners, bleListenerEntry{base: base, bl: bl})
+	return nil
+}
+
+// RemoveListener unregisters the listener that was added with this exact
+// base filter, if any.
+func (bd *BleDispatcher) RemoveListener(base BleMsgBase) {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	for i, e := range bd.listeners {
+		if e.base == base {
+			bd.listeners = append(bd.listeners[:i], bd.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// ErrorAll delivers err to every registered listener, non-blocking.  Called
+// on transport shutdown so that no listener is left waiting forever for a
+// message that will never arrive.
+func (bd *BleDispatcher) ErrorAll(err error) {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	for _, e := range bd.listeners {
+		select {
+		case e.bl.ErrChan <- err:
+		default:
+		}
+	}
+}
+
+// Clear unregisters every listener.  Called at the start of each
+// startOnce() so that a restart doesn't leave stale listeners registered
+// against connections that no longer exist.
+func (bd *BleDispatcher) Clear() {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	bd.listeners = nil
+}
+
+func baseMatches(filter, base BleMsgBase) bool {
+	return (filter.Op == -1 || filter.Op == base.Op) &&
+		(filter.Type == -1 || filter.Type == base.Type) &&
+		(filter.Seq == -1 || filter.Seq == base.Seq) &&
+		(filter.ConnHandle == -1 || filter.ConnHandle == base.ConnHandle)
+}
+
+// Dispatch decodes a single JSON frame received from blehostd and delivers
+// it to every listener whose filter matches.  Frames with no registered
+// decoder, or that fail to decode, are dropped; Dispatch never blocks on a
+// full listener channel.
+func (bd *BleDispatcher) Dispatch(buf []byte) {
+	var base BleMsgBase
+	if err := json.Unmarshal(buf, &base); err != nil {
+		log.Debugf("Failed to decode BLE message header: %s", err.Error())
+		return
+	}
+
+	ctor := lookupBleMsgCtor(base.Op, base.Type)
+	if ctor == nil {
+		log.Debugf(
+			"No decoder registered for BLE message op=%d type=%d",
+			base.Op, base.Type)
+		return
+	}
+
+	msg := ctor()
+	if err := json.Unmarshal(buf, msg); err != nil {
+		log.Debugf("Failed to decode BLE message body: %s", err.Error())
+		return
+	}
+
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	for _, e := range bd.listeners {
+		if !baseMatches(e.base, base) {
+			continue
+		}
+
+		select {
+		case e.bl.BleChan <- msg:
+		default:
+			log.Debugf(
+				"Dropped BLE message op=%d type=%d seq=%d: listener channel full",
+				base.Op, base.Type, base.Seq)
+		}
+	}
+}
+
+// QueueDepth returns the total number of decoded messages sitting in
+// listener channels, waiting for their owner to consume them.
+func (bd *BleDispatcher) QueueDepth() int {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	depth := 0
+	for _, e := range bd.listeners {
+		depth += len(e.bl.BleChan)
+	}
+	return depth
+}
+
+// ListenerCount returns the number of listeners currently registered.
+func (bd *BleDispatcher) ListenerCount() int {
+	bd.mtx.Lock()
+	defer bd.mtx.Unlock()
+
+	return len(bd.listeners)
+}
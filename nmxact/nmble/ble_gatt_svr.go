@@ -0,0 +1,543 @@
+package nmble
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"mynewt.apache.org/newtmgr/nmxact/nmxutil"
+)
+
+// New BLE_GATT message types used by the peripheral (GATT server) surface.
+// These continue the MSG_TYPE_* sequence started in ble_dispatch.go rather
+// than picking an arbitrary base of their own.
+const (
+	MSG_TYPE_GATT_REGISTER_SVCS = MSG_TYPE_ADV_EVT + 1 + iota
+	MSG_TYPE_GATT_ACCESS_EVT
+	MSG_TYPE_GATT_ACCESS_RSP
+	MSG_TYPE_GATT_SUBSCRIBE_EVT
+	MSG_TYPE_GATT_MTU_EVT
+	MSG_TYPE_GATT_CONN_EVT
+)
+
+func init() {
+	RegisterBleMsgType(MSG_OP_RSP, MSG_TYPE_GATT_REGISTER_SVCS,
+		func() BleMsg { return &bleGattRegisterSvcsRsp{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_GATT_ACCESS_EVT,
+		func() BleMsg { return &bleGattAccessEvt{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_GATT_SUBSCRIBE_EVT,
+		func() BleMsg { return &bleGattSubscribeEvt{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_GATT_MTU_EVT,
+		func() BleMsg { return &bleGattMtuEvt{} })
+	RegisterBleMsgType(MSG_OP_EVT, MSG_TYPE_GATT_CONN_EVT,
+		func() BleMsg { return &bleGattConnEvt{} })
+}
+
+// BleUuid represents either a standard 16-bit Bluetooth SIG UUID or a
+// vendor-specific 128-bit UUID.  Uuid16 is non-zero for the former; Uuid128
+// is used otherwise.
+type BleUuid struct {
+	Uuid16  uint16   `json:"uuid16,omitempty"`
+	Uuid128 [16]byte `json:"uuid128,omitempty"`
+}
+
+func NewBleUuid16(v uint16) BleUuid {
+	return BleUuid{Uuid16: v}
+}
+
+func NewBleUuid128(b [16]byte) BleUuid {
+	return BleUuid{Uuid128: b}
+}
+
+type BleGattSvcType int
+
+const (
+	BLE_GATT_SVC_TYPE_PRIMARY BleGattSvcType = iota
+	BLE_GATT_SVC_TYPE_SECONDARY
+)
+
+type BleGattAccessOp int
+
+const (
+	BLE_GATT_ACCESS_OP_READ_CHR BleGattAccessOp = iota
+	BLE_GATT_ACCESS_OP_WRITE_CHR
+	BLE_GATT_ACCESS_OP_READ_DSC
+	BLE_GATT_ACCESS_OP_WRITE_DSC
+)
+
+// BleGattAccessCtxt describes a single incoming read or write.  For a read,
+// the handler returns the data to send back; for a write, Data holds what
+// the peer sent.
+type BleGattAccessCtxt struct {
+	Op         BleGattAccessOp
+	ConnHandle int
+	AttrHandle int
+	Data       []byte
+}
+
+// BleGattAccessFn handles a characteristic or descriptor read/write.  It
+// returns the data to return to the peer (read) or nil (write), and an
+// ATT status code (0 on success).
+type BleGattAccessFn func(ctxt *BleGattAccessCtxt) ([]byte, uint8)
+
+// BleGattSubscribeFn is invoked when a peer enables or disables
+// notifications/indications on a characteristic.
+type BleGattSubscribeFn func(connHandle int, notify bool, indicate bool)
+
+// BleGattMtuFn is invoked when the ATT MTU for a connection is negotiated
+// or renegotiated.
+type BleGattMtuFn func(connHandle int, mtu int)
+
+// BleGattConnFn is invoked when a central connects to or disconnects from
+// our GATT server.
+type BleGattConnFn func(connHandle int, connected bool)
+
+type bleGattMtuEvt struct {
+	ConnHandle int `json:"conn_handle"`
+	Mtu        int `json:"mtu"`
+}
+
+type bleGattConnEvt struct {
+	ConnHandle int  `json:"conn_handle"`
+	Connected  bool `json:"connected"`
+}
+
+type GattDsc struct {
+	Uuid     BleUuid
+	AttFlags uint8
+	AccessFn BleGattAccessFn `json:"-"`
+
+	handle int
+}
+
+type GattChr struct {
+	Uuid        BleUuid
+	Flags       uint16
+	AccessFn    BleGattAccessFn    `json:"-"`
+	SubscribeFn BleGattSubscribeFn `json:"-"`
+	Dscs        []*GattDsc
+
+	defHandle int
+	valHandle int
+}
+
+type GattSvc struct {
+	Uuid BleUuid
+	Type BleGattSvcType
+	Chrs []*GattChr
+
+	handle int
+}
+
+type bleGattRegisterSvcsReq struct {
+	Op   int        `json:"op"`
+	Type int        `json:"type"`
+	Seq  int        `json:"seq"`
+	Svcs []*GattSvc `json:"svcs"`
+}
+
+type bleGattAccessEvt struct {
+	Op         BleGattAccessOp `json:"access_op"`
+	Seq        int             `json:"seq"`
+	ConnHandle int             `json:"conn_handle"`
+	AttrHandle int             `json:"attr_handle"`
+	Data       []byte          `json:"data"`
+}
+
+type bleGattAccessRsp struct {
+	Op     int    `json:"op"`
+	Type   int    `json:"type"`
+	Seq    int    `json:"seq"`
+	Status uint8  `json:"status"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// bleGattRegisterSvcsRsp reports the attribute handles blehostd assigned to
+// each registered service/characteristic/descriptor, in the same order they
+// were sent in bleGattRegisterSvcsReq.Svcs.
+type bleGattRegisterSvcsRsp struct {
+	Svcs []bleGattSvcHandles `json:"svcs"`
+}
+
+type bleGattSvcHandles struct {
+	Handle int                 `json:"handle"`
+	Chrs   []bleGattChrHandles `json:"chrs"`
+}
+
+type bleGattChrHandles struct {
+	DefHandle  int   `json:"def_handle"`
+	ValHandle  int   `json:"val_handle"`
+	DscHandles []int `json:"dsc_handles"`
+}
+
+type bleGattSubscribeEvt struct {
+	ConnHandle int  `json:"conn_handle"`
+	AttrHandle int  `json:"attr_handle"`
+	Notify     bool `json:"notify"`
+	Indicate   bool `json:"indicate"`
+}
+
+// GattSvcRegistrar lets a Go program host the newtmgr GATT service (or any
+// other service) itself, accepting incoming connections and NMP traffic
+// over BLE instead of only initiating it.  Callers add service/
+// characteristic/descriptor definitions with read/write/notify/indicate
+// handlers, then call Register() once to hand the whole set to blehostd.
+type GattSvcRegistrar struct {
+	bx   *BleXport
+	svcs []*GattSvc
+
+	// MtuFn and ConnFn are optional; set them before calling Register() to
+	// be notified of MTU renegotiation and central connect/disconnect
+	// events for this GATT server.
+	MtuFn  BleGattMtuFn
+	ConnFn BleGattConnFn
+
+	accessBl      *BleListener
+	subBl         *BleListener
+	mtuBl         *BleListener
+	connBl        *BleListener
+	attrsByHandle map[int]interface{}
+}
+
+func NewGattSvcRegistrar(bx *BleXport) *GattSvcRegistrar {
+	return &GattSvcRegistrar{
+		bx:            bx,
+		attrsByHandle: map[int]interface{}{},
+	}
+}
+
+// AddService queues a service definition to be registered with blehostd.
+// Call Register() once all services have been added.
+func (r *GattSvcRegistrar) AddService(svc *GattSvc) {
+	r.svcs = append(r.svcs, svc)
+}
+
+// Register hands all queued services to blehostd and starts servicing
+// characteristic/descriptor accesses and subscription changes in the
+// background for as long as the transport is up.
+func (r *GattSvcRegistrar) Register() error {
+	req := &bleGattRegisterSvcsReq{
+		Op:   MSG_OP_REQ,
+		Type: MSG_TYPE_GATT_REGISTER_SVCS,
+		Seq:  NextSeq(),
+		Svcs: r.svcs,
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	rspBl := NewBleListener()
+	rspBase := BleMsgBase{Op: -1, Type: -1, Seq: req.Seq, ConnHandle: -1}
+	if err := r.bx.Bd.AddListener(rspBase, rspBl); err != nil {
+		return err
+	}
+	defer r.bx.Bd.RemoveListener(rspBase)
+
+	if err := r.bx.Tx(j); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-rspBl.ErrChan:
+		return err
+	case bm := <-rspBl.BleChan:
+		rsp, ok := bm.(*bleGattRegisterSvcsRsp)
+		if !ok {
+			return nmxutil.NewXportError(
+				"Unexpected response type for GATT service registration")
+		}
+		if err := r.applyHandles(rsp); err != nil {
+			return err
+		}
+	}
+
+	for _, svc := range r.svcs {
+		for _, chr := range svc.Chrs {
+			r.attrsByHandle[chr.valHandle] = chr
+			for _, dsc := range chr.Dscs {
+				r.attrsByHandle[dsc.handle] = dsc
+			}
+		}
+	}
+
+	accessBl := NewBleListener()
+	accessBase := BleMsgBase{
+		Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_ACCESS_EVT, Seq: -1, ConnHandle: -1,
+	}
+	if err := r.bx.Bd.AddListener(accessBase, accessBl); err != nil {
+		return err
+	}
+	r.accessBl = accessBl
+
+	subBl := NewBleListener()
+	subBase := BleMsgBase{
+		Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_SUBSCRIBE_EVT, Seq: -1, ConnHandle: -1,
+	}
+	if err := r.bx.Bd.AddListener(subBase, subBl); err != nil {
+		r.bx.Bd.RemoveListener(accessBase)
+		return err
+	}
+	r.subBl = subBl
+
+	mtuBl := NewBleListener()
+	mtuBase := BleMsgBase{
+		Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_MTU_EVT, Seq: -1, ConnHandle: -1,
+	}
+	if err := r.bx.Bd.AddListener(mtuBase, mtuBl); err != nil {
+		r.bx.Bd.RemoveListener(accessBase)
+		r.bx.Bd.RemoveListener(subBase)
+		return err
+	}
+	r.mtuBl = mtuBl
+
+	connBl := NewBleListener()
+	connBase := BleMsgBase{
+		Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_CONN_EVT, Seq: -1, ConnHandle: -1,
+	}
+	if err := r.bx.Bd.AddListener(connBase, connBl); err != nil {
+		r.bx.Bd.RemoveListener(accessBase)
+		r.bx.Bd.RemoveListener(subBase)
+		r.bx.Bd.RemoveListener(mtuBase)
+		return err
+	}
+	r.connBl = connBl
+
+	go r.serveAccesses()
+	go r.serveSubscribes()
+	go r.serveMtu()
+	go r.serveConn()
+
+	return nil
+}
+
+// applyHandles copies the attribute handles blehostd assigned during
+// registration into the corresponding GattSvc/GattChr/GattDsc, so that
+// incoming bleGattAccessEvt/bleGattSubscribeEvt messages (which only carry
+// an AttrHandle) can be matched back to the handler that owns it.
+func (r *GattSvcRegistrar) applyHandles(rsp *bleGattRegisterSvcsRsp) error {
+	if len(rsp.Svcs) != len(r.svcs) {
+		return nmxutil.NewXportError(fmt.Sprintf(
+			"blehostd returned %d service handle sets for %d registered "+
+				"services", len(rsp.Svcs), len(r.svcs)))
+	}
+
+	for i, svc := range r.svcs {
+		svcH := rsp.Svcs[i]
+		svc.handle = svcH.Handle
+
+		if len(svcH.Chrs) != len(svc.Chrs) {
+			return nmxutil.NewXportError(fmt.Sprintf(
+				"blehostd returned %d characteristic handle sets for "+
+					"service with %d characteristics",
+				len(svcH.Chrs), len(svc.Chrs)))
+		}
+
+		for j, chr := range svc.Chrs {
+			chrH := svcH.Chrs[j]
+			chr.defHandle = chrH.DefHandle
+			chr.valHandle = chrH.ValHandle
+
+			if len(chrH.DscHandles) != len(chr.Dscs) {
+				return nmxutil.NewXportError(fmt.Sprintf(
+					"blehostd returned %d descriptor handles for "+
+						"characteristic with %d descriptors",
+					len(chrH.DscHandles), len(chr.Dscs)))
+			}
+
+			for k, dsc := range chr.Dscs {
+				dsc.handle = chrH.DscHandles[k]
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *GattSvcRegistrar) serveAccesses() {
+	for {
+		select {
+		case err, ok := <-r.accessBl.ErrChan:
+			if !ok {
+				return
+			}
+			log.Debugf("GATT access listener terminated: %s", err.Error())
+			return
+
+		case bm, ok := <-r.accessBl.BleChan:
+			if !ok {
+				return
+			}
+
+			evt, ok := bm.(*bleGattAccessEvt)
+			if !ok {
+				continue
+			}
+
+			attr, ok := r.attrsByHandle[evt.AttrHandle]
+			if !ok {
+				continue
+			}
+
+			var accessFn BleGattAccessFn
+			switch a := attr.(type) {
+			case *GattChr:
+				accessFn = a.AccessFn
+			case *GattDsc:
+				accessFn = a.AccessFn
+			}
+
+			status := uint8(0)
+			var data []byte
+			if accessFn != nil {
+				data, status = accessFn(&BleGattAccessCtxt{
+					Op:         evt.Op,
+					ConnHandle: evt.ConnHandle,
+					AttrHandle: evt.AttrHandle,
+					Data:       evt.Data,
+				})
+			} else {
+				status = 1
+			}
+
+			rsp := &bleGattAccessRsp{
+				Op:     MSG_OP_RSP,
+				Type:   MSG_TYPE_GATT_ACCESS_RSP,
+				Seq:    evt.Seq,
+				Status: status,
+				Data:   data,
+			}
+			j, err := json.Marshal(rsp)
+			if err != nil {
+				log.Debugf("Failed to marshal GATT access response: %s",
+					err.Error())
+				continue
+			}
+			if err := r.bx.Tx(j); err != nil {
+				log.Debugf("Failed to send GATT access response: %s",
+					err.Error())
+			}
+		}
+	}
+}
+
+func (r *GattSvcRegistrar) serveSubscribes() {
+	for {
+		select {
+		case _, ok := <-r.subBl.ErrChan:
+			if !ok {
+				return
+			}
+			return
+
+		case bm, ok := <-r.subBl.BleChan:
+			if !ok {
+				return
+			}
+
+			evt, ok := bm.(*bleGattSubscribeEvt)
+			if !ok {
+				continue
+			}
+
+			attr, ok := r.attrsByHandle[evt.AttrHandle]
+			if !ok {
+				continue
+			}
+
+			chr, ok := attr.(*GattChr)
+			if !ok || chr.SubscribeFn == nil {
+				continue
+			}
+
+			chr.SubscribeFn(evt.ConnHandle, evt.Notify, evt.Indicate)
+		}
+	}
+}
+
+func (r *GattSvcRegistrar) serveMtu() {
+	for {
+		select {
+		case _, ok := <-r.mtuBl.ErrChan:
+			if !ok {
+				return
+			}
+			return
+
+		case bm, ok := <-r.mtuBl.BleChan:
+			if !ok {
+				return
+			}
+
+			evt, ok := bm.(*bleGattMtuEvt)
+			if !ok {
+				continue
+			}
+
+			if r.MtuFn != nil {
+				r.MtuFn(evt.ConnHandle, evt.Mtu)
+			}
+		}
+	}
+}
+
+func (r *GattSvcRegistrar) serveConn() {
+	for {
+		select {
+		case _, ok := <-r.connBl.ErrChan:
+			if !ok {
+				return
+			}
+			return
+
+		case bm, ok := <-r.connBl.BleChan:
+			if !ok {
+				return
+			}
+
+			evt, ok := bm.(*bleGattConnEvt)
+			if !ok {
+				continue
+			}
+
+			if r.ConnFn != nil {
+				r.ConnFn(evt.ConnHandle, evt.Connected)
+			}
+		}
+	}
+}
+
+// Unregister stops servicing accesses, subscriptions, MTU changes, and
+// connect/disconnect events for this registrar's services.
+func (r *GattSvcRegistrar) Unregister() {
+	if r.accessBl != nil {
+		base := BleMsgBase{
+			Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_ACCESS_EVT, Seq: -1, ConnHandle: -1,
+		}
+		r.bx.Bd.RemoveListener(base)
+		r.accessBl = nil
+	}
+	if r.subBl != nil {
+		base := BleMsgBase{
+			Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_SUBSCRIBE_EVT, Seq: -1, ConnHandle: -1,
+		}
+		r.bx.Bd.RemoveListener(base)
+		r.subBl = nil
+	}
+	if r.mtuBl != nil {
+		base := BleMsgBase{
+			Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_MTU_EVT, Seq: -1, ConnHandle: -1,
+		}
+		r.bx.Bd.RemoveListener(base)
+		r.mtuBl = nil
+	}
+	if r.connBl != nil {
+		base := BleMsgBase{
+			Op: MSG_OP_EVT, Type: MSG_TYPE_GATT_CONN_EVT, Seq: -1, ConnHandle: -1,
+		}
+		r.bx.Bd.RemoveListener(base)
+		r.connBl = nil
+	}
+}
@@ -0,0 +1,174 @@
+package nmble
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"mynewt.apache.org/newtmgr/nmxact/nmxutil"
+)
+
+// MasterPriority indicates how urgently a caller needs the master role.  A
+// higher-priority waiter is granted the resource ahead of any
+// lower-priority waiters already in the queue, even though it arrived
+// later.  Waiters of equal priority are served FIFO.
+type MasterPriority int
+
+const (
+	BLE_MASTER_PRIO_BACKGROUND MasterPriority = iota
+	BLE_MASTER_PRIO_NORMAL
+	BLE_MASTER_PRIO_HIGH
+)
+
+type masterWaiter struct {
+	prio     MasterPriority
+	grantCh  chan error
+	canceled bool
+}
+
+// MasterResource arbitrates access to the single-controller host's master
+// role (connect / scan / discover).  Only one of these operations can be in
+// flight at a time, so sessions must Acquire the resource before initiating
+// one and Release it once the connection reaches a stable state or fails.
+//
+// Waiters are queued FIFO within a priority level; a higher-priority waiter
+// (e.g. an active user command) jumps ahead of queued lower-priority
+// waiters (e.g. a background scan).
+type MasterResource struct {
+	mtx    sync.Mutex
+	held   bool
+	queues [3]*list.List
+}
+
+func NewMasterResource() *MasterResource {
+	mr := &MasterResource{}
+	for i := range mr.queues {
+		mr.queues[i] = list.New()
+	}
+	return mr
+}
+
+// Acquire blocks until the caller is granted the master role, the context
+// is canceled, or the resource is reset (e.g., due to a transport
+// shutdown).
+func (mr *MasterResource) Acquire(ctx context.Context, prio MasterPriority) error {
+	mr.mtx.Lock()
+
+	if !mr.held {
+		mr.held = true
+		mr.mtx.Unlock()
+		return nil
+	}
+
+	w := &masterWaiter{
+		prio:    prio,
+		grantCh: make(chan error, 1),
+	}
+	elem := mr.queues[prio].PushBack(w)
+	mr.mtx.Unlock()
+
+	select {
+	case err := <-w.grantCh:
+		return err
+
+	case <-ctx.Done():
+		mr.mtx.Lock()
+		if !w.canceled {
+			w.canceled = true
+			mr.queues[prio].Remove(elem)
+			mr.mtx.Unlock()
+			return ctx.Err()
+		}
+
+		// grantNextLocked already fired for this waiter and raced with our
+		// ctx cancellation; w.grantCh is buffered, so this never blocks.
+		// If it was a real grant (not a reset error), the resource is now
+		// held on our behalf and nobody will ever call Release for it --
+		// hand it to the next waiter instead of leaking it.
+		grantErr := <-w.grantCh
+		if grantErr == nil {
+			mr.grantNextLocked(nil)
+		}
+		mr.mtx.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Release relinquishes the master role and grants it to the
+// highest-priority, longest-waiting queued caller, if any.
+func (mr *MasterResource) Release() {
+	mr.mtx.Lock()
+	defer mr.mtx.Unlock()
+
+	mr.grantNextLocked(nil)
+}
+
+// reset drops every current holder and queued waiter, unblocking them all
+// with the given error.  BleXport calls this from startOnce() so that a
+// restart doesn't leave stale waiters stuck behind a master role that no
+// longer means anything.
+func (mr *MasterResource) reset(err error) {
+	mr.mtx.Lock()
+	defer mr.mtx.Unlock()
+
+	mr.held = false
+	for _, q := range mr.queues {
+		for elem := q.Front(); elem != nil; elem = elem.Next() {
+			w := elem.Value.(*masterWaiter)
+			w.canceled = true
+			w.grantCh <- err
+		}
+		q.Init()
+	}
+}
+
+// grantNextLocked hands the master role to the next eligible waiter, in
+// priority order then FIFO order, or marks the resource free if there are
+// no waiters.  Must be called with mr.mtx held.
+func (mr *MasterResource) grantNextLocked(err error) {
+	for prio := len(mr.queues) - 1; prio >= 0; prio-- {
+		q := mr.queues[prio]
+		elem := q.Front()
+		if elem == nil {
+			continue
+		}
+
+		w := elem.Value.(*masterWaiter)
+		w.canceled = true
+		q.Remove(elem)
+		w.grantCh <- err
+		if err == nil {
+			mr.held = true
+		}
+		return
+	}
+
+	mr.held = false
+}
+
+// AcquireMaster blocks until the caller may perform a master-role operation
+// (connect / scan / discover), or until ctx is canceled.  Callers must pair
+// a successful Acquire with a subsequent call to ReleaseMaster once the
+// operation reaches a stable state or fails.
+func (bx *BleXport) AcquireMaster(ctx context.Context) error {
+	return bx.AcquireMasterPrio(ctx, BLE_MASTER_PRIO_NORMAL)
+}
+
+// AcquireMasterPrio is like AcquireMaster, but lets the caller specify a
+// priority.  An active user command should use BLE_MASTER_PRIO_HIGH so that
+// it preempts a queued background scan.
+func (bx *BleXport) AcquireMasterPrio(ctx context.Context, prio MasterPriority) error {
+	if bx.master == nil {
+		return nmxutil.NewXportError(
+			"Attempt to acquire master resource before BLE xport started")
+	}
+	return bx.master.Acquire(ctx, prio)
+}
+
+// ReleaseMaster relinquishes the master role acquired via AcquireMaster /
+// AcquireMasterPrio.
+func (bx *BleXport) ReleaseMaster() {
+	if bx.master != nil {
+		bx.master.Release()
+	}
+}
@@ -0,0 +1,158 @@
+package nmble
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMasterResourceAcquireUncontended(t *testing.T) {
+	mr := NewMasterResource()
+
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL); err != nil {
+		t.Fatalf("Acquire on a free resource returned an error: %s", err.Error())
+	}
+}
+
+func TestMasterResourceGrantOrderByPriority(t *testing.T) {
+	mr := NewMasterResource()
+
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_HIGH); err != nil {
+		t.Fatalf("initial Acquire failed: %s", err.Error())
+	}
+
+	// Queue a background and a normal waiter, in that order; the
+	// higher-priority waiter should still be granted first.
+	bgGranted := make(chan error, 1)
+	go func() {
+		bgGranted <- mr.Acquire(context.Background(), BLE_MASTER_PRIO_BACKGROUND)
+	}()
+	waitForQueued(t, mr, BLE_MASTER_PRIO_BACKGROUND, 1)
+
+	normalGranted := make(chan error, 1)
+	go func() {
+		normalGranted <- mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL)
+	}()
+	waitForQueued(t, mr, BLE_MASTER_PRIO_NORMAL, 1)
+
+	mr.Release()
+
+	select {
+	case err := <-normalGranted:
+		if err != nil {
+			t.Fatalf("normal-priority Acquire returned an error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("higher-priority waiter was not granted ahead of the queued background waiter")
+	}
+
+	select {
+	case <-bgGranted:
+		t.Fatal("background waiter was granted before the normal-priority waiter")
+	default:
+	}
+
+	mr.Release()
+
+	select {
+	case err := <-bgGranted:
+		if err != nil {
+			t.Fatalf("background-priority Acquire returned an error: %s", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("background waiter was never granted")
+	}
+}
+
+func TestMasterResourceAcquireCancel(t *testing.T) {
+	mr := NewMasterResource()
+
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL); err != nil {
+		t.Fatalf("initial Acquire failed: %s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiterDone := make(chan error, 1)
+	go func() {
+		waiterDone <- mr.Acquire(ctx, BLE_MASTER_PRIO_NORMAL)
+	}()
+	waitForQueued(t, mr, BLE_MASTER_PRIO_NORMAL, 1)
+
+	cancel()
+
+	select {
+	case err := <-waiterDone:
+		if err != ctx.Err() {
+			t.Fatalf("canceled Acquire returned %v, want %v", err, ctx.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canceled Acquire never returned")
+	}
+
+	// The canceled waiter must not have left the queue slot occupied nor
+	// the resource wedged: a subsequent waiter should still be grantable
+	// once the original holder releases.
+	mr.Release()
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL); err != nil {
+		t.Fatalf("Acquire after cancel+release failed: %s", err.Error())
+	}
+}
+
+func TestMasterResourceReset(t *testing.T) {
+	mr := NewMasterResource()
+
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL); err != nil {
+		t.Fatalf("initial Acquire failed: %s", err.Error())
+	}
+
+	waiterDone := make(chan error, 1)
+	go func() {
+		waiterDone <- mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL)
+	}()
+	waitForQueued(t, mr, BLE_MASTER_PRIO_NORMAL, 1)
+
+	resetErr := errTestReset
+	mr.reset(resetErr)
+
+	select {
+	case err := <-waiterDone:
+		if err != resetErr {
+			t.Fatalf("reset Acquire returned %v, want %v", err, resetErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("queued waiter was never unblocked by reset")
+	}
+
+	// reset() must also clear the held flag so the resource is immediately
+	// acquirable again, as BleXport relies on after a restart.
+	if err := mr.Acquire(context.Background(), BLE_MASTER_PRIO_NORMAL); err != nil {
+		t.Fatalf("Acquire after reset failed: %s", err.Error())
+	}
+}
+
+var errTestReset = contextErr("simulated transport reset")
+
+type contextErr string
+
+func (e contextErr) Error() string { return string(e) }
+
+// waitForQueued polls until prio's queue reaches the given length or fails
+// the test after a short timeout.  Acquire() enqueues asynchronously from
+// the caller's goroutine, so tests that depend on queue order must wait for
+// the enqueue to land before racing Release()/cancel() against it.
+func waitForQueued(t *testing.T, mr *MasterResource, prio MasterPriority, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		mr.mtx.Lock()
+		len := mr.queues[prio].Len()
+		mr.mtx.Unlock()
+
+		if len >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d waiter(s) at priority %d", n, prio)
+}
@@ -0,0 +1,141 @@
+package nmble
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// XportObserver lets an embedder watch a BleXport's internal events without
+// patching it: wiring a Prometheus exporter, structured logs, or a health
+// endpoint off of logrus debug output alone isn't practical in production.
+// Implementations should return quickly; callbacks are invoked synchronously
+// from the transport's internal goroutines.
+type XportObserver interface {
+	OnStateChange(from, to BleXportState)
+	OnRestart(attempt int, lastErr error)
+	OnSyncLost(err error)
+	OnTx(nBytes int)
+	OnRx(nBytes int)
+	OnDispatchDrop(reason string)
+}
+
+// XportStats is a point-in-time snapshot of a BleXport's activity, suitable
+// for polling from a health check or metrics scrape.
+type XportStats struct {
+	TxBytes      uint64
+	RxBytes      uint64
+	TxMsgs       uint64
+	RxMsgs       uint64
+	RestartCount uint64
+
+	// Uptime is the time since the transport last reached the started
+	// state.  It is zero if the transport isn't currently started.
+	Uptime time.Duration
+
+	// DispatchQueueDepth is the number of decoded messages currently
+	// buffered in listener channels, waiting for their owner to consume
+	// them.
+	DispatchQueueDepth int
+
+	// ListenerCount is the number of listeners currently registered with
+	// this transport's BleDispatcher.
+	ListenerCount int
+}
+
+type xportCounters struct {
+	txBytes  uint64
+	rxBytes  uint64
+	txMsgs   uint64
+	rxMsgs   uint64
+	restarts uint64
+}
+
+// AddObserver registers o to receive callbacks for this transport's
+// lifecycle and I/O events.  It may be called at any time, including before
+// Start().
+func (bx *BleXport) AddObserver(o XportObserver) {
+	bx.observerMtx.Lock()
+	defer bx.observerMtx.Unlock()
+
+	bx.observers = append(bx.observers, o)
+}
+
+func (bx *BleXport) observerSnapshot() []XportObserver {
+	bx.observerMtx.Lock()
+	defer bx.observerMtx.Unlock()
+
+	if len(bx.observers) == 0 {
+		return nil
+	}
+	cp := make([]XportObserver, len(bx.observers))
+	copy(cp, bx.observers)
+	return cp
+}
+
+func (bx *BleXport) notifyStateChange(from, to BleXportState) {
+	for _, o := range bx.observerSnapshot() {
+		o.OnStateChange(from, to)
+	}
+}
+
+func (bx *BleXport) notifyRestart(attempt int, lastErr error) {
+	atomic.AddUint64(&bx.counters.restarts, 1)
+	for _, o := range bx.observerSnapshot() {
+		o.OnRestart(attempt, lastErr)
+	}
+}
+
+func (bx *BleXport) notifySyncLost(err error) {
+	for _, o := range bx.observerSnapshot() {
+		o.OnSyncLost(err)
+	}
+}
+
+func (bx *BleXport) notifyTx(nBytes int) {
+	atomic.AddUint64(&bx.counters.txBytes, uint64(nBytes))
+	atomic.AddUint64(&bx.counters.txMsgs, 1)
+	for _, o := range bx.observerSnapshot() {
+		o.OnTx(nBytes)
+	}
+}
+
+func (bx *BleXport) notifyRx(nBytes int) {
+	atomic.AddUint64(&bx.counters.rxBytes, uint64(nBytes))
+	atomic.AddUint64(&bx.counters.rxMsgs, 1)
+	for _, o := range bx.observerSnapshot() {
+		o.OnRx(nBytes)
+	}
+}
+
+func (bx *BleXport) notifyDispatchDrop(reason string) {
+	for _, o := range bx.observerSnapshot() {
+		o.OnDispatchDrop(reason)
+	}
+}
+
+// Stats returns a snapshot of this transport's tx/rx counters, restart
+// count, current uptime, and dispatcher load.
+func (bx *BleXport) Stats() XportStats {
+	stats := XportStats{
+		TxBytes:      atomic.LoadUint64(&bx.counters.txBytes),
+		RxBytes:      atomic.LoadUint64(&bx.counters.rxBytes),
+		TxMsgs:       atomic.LoadUint64(&bx.counters.txMsgs),
+		RxMsgs:       atomic.LoadUint64(&bx.counters.rxMsgs),
+		RestartCount: atomic.LoadUint64(&bx.counters.restarts),
+	}
+
+	bx.stateMtx.Lock()
+	startedAt := bx.startedAt
+	bx.stateMtx.Unlock()
+
+	if bx.getState() == BLE_XPORT_STATE_STARTED && !startedAt.IsZero() {
+		stats.Uptime = time.Since(startedAt)
+	}
+
+	if bx.Bd != nil {
+		stats.DispatchQueueDepth = bx.Bd.QueueDepth()
+		stats.ListenerCount = bx.Bd.ListenerCount()
+	}
+
+	return stats
+}
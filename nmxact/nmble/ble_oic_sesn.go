@@ -0,0 +1,85 @@
+package nmble
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mynewt.apache.org/newtmgr/nmxact/sesn"
+)
+
+// BleOicSesn is a BLE session that exchanges OIC-encapsulated requests and
+// responses, as opposed to the plain NMP encoding used by BlePlainSesn.
+type BleOicSesn struct {
+	bx  *BleXport
+	cfg sesn.SesnCfg
+
+	// OpenTimeout bounds how long Open() will wait for the transport to
+	// start and for the master role to become available.  It defaults to
+	// DfltOpenTimeout; set it (or use a context-free 0 for "wait forever")
+	// before calling Open().
+	OpenTimeout time.Duration
+
+	// MasterPrio is the priority Open() requests the master role with.  It
+	// defaults to BLE_MASTER_PRIO_HIGH, appropriate for a session opened in
+	// response to a user command; a caller driving a background task (e.g.
+	// periodic polling) should lower it so it doesn't preempt the user.
+	MasterPrio MasterPriority
+
+	mtx    sync.Mutex
+	isOpen bool
+}
+
+func NewBleOicSesn(bx *BleXport, cfg sesn.SesnCfg) *BleOicSesn {
+	return &BleOicSesn{
+		bx:          bx,
+		cfg:         cfg,
+		OpenTimeout: DfltOpenTimeout,
+		MasterPrio:  BLE_MASTER_PRIO_HIGH,
+	}
+}
+
+// Open waits for the transport to finish (re)starting, then acquires the
+// master role, so that an open attempt rides out a blehostd restart instead
+// of racing it and doesn't step on another session's in-flight
+// connect/scan/discover operation.  Both waits are bounded by OpenTimeout,
+// rather than blocking forever.  Open then releases the master role and
+// marks the session open; it does not connect to a peer, discover
+// services, or pair.
+func (bo *BleOicSesn) Open() error {
+	ctx, cancel := openCtx(bo.OpenTimeout)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	if err := bo.bx.WaitUntilStarted(deadline); err != nil {
+		return err
+	}
+
+	if err := bo.bx.AcquireMasterPrio(ctx, bo.MasterPrio); err != nil {
+		return err
+	}
+	defer bo.bx.ReleaseMaster()
+
+	// No peer connect, service discovery, or pairing is performed here.
+
+	bo.mtx.Lock()
+	bo.isOpen = true
+	bo.mtx.Unlock()
+
+	return nil
+}
+
+func (bo *BleOicSesn) Close() error {
+	bo.mtx.Lock()
+	bo.isOpen = false
+	bo.mtx.Unlock()
+
+	return nil
+}
+
+func (bo *BleOicSesn) IsOpen() bool {
+	bo.mtx.Lock()
+	defer bo.mtx.Unlock()
+
+	return bo.isOpen
+}
@@ -0,0 +1,101 @@
+package nmble
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mynewt.apache.org/newtmgr/nmxact/sesn"
+)
+
+// DfltOpenTimeout is the default time Open() will wait for the transport to
+// finish starting and for the master role to become available before
+// giving up.
+const DfltOpenTimeout = 30 * time.Second
+
+// BlePlainSesn is a BLE session that exchanges NMP requests/responses
+// directly, without the OIC encapsulation used by BleOicSesn.
+type BlePlainSesn struct {
+	bx  *BleXport
+	cfg sesn.SesnCfg
+
+	// OpenTimeout bounds how long Open() will wait for the transport to
+	// start and for the master role to become available.  It defaults to
+	// DfltOpenTimeout; set it (or use a context-free 0 for "wait forever")
+	// before calling Open().
+	OpenTimeout time.Duration
+
+	// MasterPrio is the priority Open() requests the master role with.  It
+	// defaults to BLE_MASTER_PRIO_HIGH, appropriate for a session opened in
+	// response to a user command; a caller driving a background task (e.g.
+	// periodic polling) should lower it so it doesn't preempt the user.
+	MasterPrio MasterPriority
+
+	mtx    sync.Mutex
+	isOpen bool
+}
+
+func NewBlePlainSesn(bx *BleXport, cfg sesn.SesnCfg) *BlePlainSesn {
+	return &BlePlainSesn{
+		bx:          bx,
+		cfg:         cfg,
+		OpenTimeout: DfltOpenTimeout,
+		MasterPrio:  BLE_MASTER_PRIO_HIGH,
+	}
+}
+
+// Open waits for the transport to finish (re)starting, then acquires the
+// master role, so that an open attempt rides out a blehostd restart instead
+// of racing it and doesn't step on another session's in-flight
+// connect/scan/discover operation.  Both waits are bounded by OpenTimeout,
+// rather than blocking forever.  Open then releases the master role and
+// marks the session open; it does not connect to a peer, discover
+// services, or pair.
+func (bp *BlePlainSesn) Open() error {
+	ctx, cancel := openCtx(bp.OpenTimeout)
+	defer cancel()
+
+	deadline, _ := ctx.Deadline()
+	if err := bp.bx.WaitUntilStarted(deadline); err != nil {
+		return err
+	}
+
+	if err := bp.bx.AcquireMasterPrio(ctx, bp.MasterPrio); err != nil {
+		return err
+	}
+	defer bp.bx.ReleaseMaster()
+
+	// No peer connect, service discovery, or pairing is performed here.
+
+	bp.mtx.Lock()
+	bp.isOpen = true
+	bp.mtx.Unlock()
+
+	return nil
+}
+
+func (bp *BlePlainSesn) Close() error {
+	bp.mtx.Lock()
+	bp.isOpen = false
+	bp.mtx.Unlock()
+
+	return nil
+}
+
+func (bp *BlePlainSesn) IsOpen() bool {
+	bp.mtx.Lock()
+	defer bp.mtx.Unlock()
+
+	return bp.isOpen
+}
+
+// openCtx builds the context BlePlainSesn.Open / BleOicSesn.Open use to
+// bound WaitUntilStarted and AcquireMasterPrio.  A non-positive timeout
+// means "wait forever", matching the zero-value behavior these sessions had
+// before OpenTimeout was introduced.
+func openCtx(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -0,0 +1,206 @@
+package nmble
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"mynewt.apache.org/newtmgr/nmxact/nmxutil"
+)
+
+// syncTracker is the single authority on host <-> controller sync state for
+// a BleXport.  It performs the initial sync check during startOnce, then
+// runs one background goroutine that both listens for async BleSyncEvt
+// notifications and polls blehostd on a timer as a backstop in case an
+// event is missed or blehostd wedges.  Previously these three concerns
+// (initial check, event listener, timer poll) were separate, ad-hoc paths;
+// consolidating them here means there's exactly one place that decides the
+// transport has lost sync and needs to restart.
+type syncTracker struct {
+	bx *BleXport
+	bl *BleListener
+}
+
+func newSyncTracker(bx *BleXport) *syncTracker {
+	return &syncTracker{bx: bx}
+}
+
+func (st *syncTracker) addListener() error {
+	bl := NewBleListener()
+	base := BleMsgBase{
+		Op:         MSG_OP_EVT,
+		Type:       MSG_TYPE_SYNC_EVT,
+		Seq:        -1,
+		ConnHandle: -1,
+	}
+	if err := st.bx.Bd.AddListener(base, bl); err != nil {
+		return err
+	}
+
+	st.bl = bl
+	return nil
+}
+
+func (st *syncTracker) removeListener() {
+	base := BleMsgBase{
+		Op:         MSG_OP_EVT,
+		Type:       MSG_TYPE_SYNC_EVT,
+		Seq:        -1,
+		ConnHandle: -1,
+	}
+	st.bx.Bd.RemoveListener(base)
+}
+
+// querySyncStatus sends a single BleSyncReq and waits up to timeout for the
+// response.  A zero timeout means wait forever; start() passes zero for the
+// initial check, so that query ends only on a response or on an error
+// delivered to the listener (e.g., by a transport shutdown).  cfg.SyncTimeout
+// does not bound it.
+func (st *syncTracker) querySyncStatus(timeout time.Duration) (bool, error) {
+	req := &BleSyncReq{
+		Op:   MSG_OP_REQ,
+		Type: MSG_TYPE_SYNC,
+		Seq:  NextSeq(),
+	}
+
+	j, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	bl := NewBleListener()
+	base := BleMsgBase{
+		Op:         -1,
+		Type:       -1,
+		Seq:        req.Seq,
+		ConnHandle: -1,
+	}
+	if err := st.bx.Bd.AddListener(base, bl); err != nil {
+		return false, err
+	}
+	defer st.bx.Bd.RemoveListener(base)
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+
+	st.bx.txNoSync(j)
+	for {
+		select {
+		case err := <-bl.ErrChan:
+			return false, err
+		case bm := <-bl.BleChan:
+			switch msg := bm.(type) {
+			case *BleSyncRsp:
+				return msg.Synced, nil
+			}
+		case <-timeoutChan:
+			return false, nmxutil.NewXportError(
+				"Timeout waiting for sync status response")
+		}
+	}
+}
+
+// start performs the initial sync check, then launches the background
+// tracking goroutine.  The initial status query has no timeout; if it
+// reports not synced, the wait for a sync event is bounded by
+// cfg.SyncTimeout.
+func (st *syncTracker) start() error {
+	if err := st.addListener(); err != nil {
+		return err
+	}
+
+	synced, err := st.querySyncStatus(0)
+	if err != nil {
+		st.removeListener()
+		return err
+	}
+
+	if !synced {
+		// Not synced yet.  Wait for the initial sync event.
+	SyncLoop:
+		for {
+			select {
+			case err := <-st.bl.ErrChan:
+				st.removeListener()
+				return err
+			case bm := <-st.bl.BleChan:
+				switch msg := bm.(type) {
+				case *BleSyncEvt:
+					if msg.Synced {
+						break SyncLoop
+					}
+				}
+			case <-time.After(st.bx.cfg.SyncTimeout):
+				st.removeListener()
+				return nmxutil.NewXportError(
+					"Timeout waiting for host <-> controller sync")
+			}
+		}
+	}
+
+	go st.run()
+	return nil
+}
+
+// run is the sole goroutine responsible for deciding that sync has been
+// lost.  It listens for BleSyncEvt notifications and, if
+// cfg.SyncCheckInterval is nonzero, also polls blehostd on that interval as
+// a backstop.  Either path shuts the transport down on failure.
+func (st *syncTracker) run() {
+	bx := st.bx
+	bx.numStopListeners++
+
+	var tickChan <-chan time.Time
+	if bx.cfg.SyncCheckInterval > 0 {
+		ticker := time.NewTicker(bx.cfg.SyncCheckInterval)
+		defer ticker.Stop()
+		tickChan = ticker.C
+	}
+
+	for {
+		select {
+		case err := <-st.bl.ErrChan:
+			bx.notifySyncLost(err)
+			go bx.shutdown(true, err)
+			// Don't return: bx.numStopListeners already counts this
+			// goroutine, and shutdown() expects every counted goroutine to
+			// keep running until it receives on bx.stopChan.
+
+		case bm := <-st.bl.BleChan:
+			switch msg := bm.(type) {
+			case *BleSyncEvt:
+				if !msg.Synced {
+					err := nmxutil.NewXportError(
+						"BLE host <-> controller sync lost")
+					bx.notifySyncLost(err)
+					go bx.shutdown(true, err)
+				}
+			}
+
+		case <-tickChan:
+			// Once a shutdown is already underway there's no point polling
+			// again; just wait for the stop signal like everyone else.
+			if bx.getState() != BLE_XPORT_STATE_STARTED {
+				continue
+			}
+
+			synced, err := st.querySyncStatus(bx.cfg.BlehostdRspTimeout)
+			if err != nil {
+				pollErr := nmxutil.NewXportError(fmt.Sprintf(
+					"sync poll failed: %s", err.Error()))
+				bx.notifySyncLost(pollErr)
+				go bx.shutdown(true, pollErr)
+			} else if !synced {
+				pollErr := nmxutil.NewXportError(
+					"sync poll failed: controller reports not synced")
+				bx.notifySyncLost(pollErr)
+				go bx.shutdown(true, pollErr)
+			}
+
+		case <-bx.stopChan:
+			return
+		}
+	}
+}
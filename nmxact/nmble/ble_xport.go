@@ -2,8 +2,8 @@ package nmble
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -36,6 +36,24 @@ type XportCfg struct {
 
 	// How long to allow for the host and controller to sync at startup.
 	SyncTimeout time.Duration
+
+	// How often the background sync tracker polls blehostd for sync
+	// status as a backstop against a missed or dropped BleSyncEvt.  0
+	// disables polling and relies solely on the event listener.
+	SyncCheckInterval time.Duration
+
+	// Maximum number of consecutive restart attempts the background
+	// restart loop will make after an unexpected shutdown before giving
+	// up and putting the transport into the permanent failure state.  A
+	// value <= 0 means retry forever (the historical behavior).
+	MaxRestartAttempts int
+
+	// Initial delay before the first restart attempt.  This doubles
+	// after each subsequent failed attempt, up to RestartBackoffMax.
+	RestartBackoff time.Duration
+
+	// Upper bound on the restart backoff delay.
+	RestartBackoffMax time.Duration
 }
 
 func NewXportCfg() XportCfg {
@@ -44,6 +62,9 @@ func NewXportCfg() XportCfg {
 		BlehostdRspTimeout:    time.Second,
 		BlehostdRestart:       true,
 		SyncTimeout:           10 * time.Second,
+		SyncCheckInterval:     30 * time.Second,
+		RestartBackoff:        time.Second,
+		RestartBackoffMax:     30 * time.Second,
 	}
 }
 
@@ -54,6 +75,13 @@ const (
 	BLE_XPORT_STATE_STARTING
 	BLE_XPORT_STATE_STARTED
 	BLE_XPORT_STATE_STOPPING
+
+	// BLE_XPORT_STATE_FAILED is a terminal state.  The transport enters
+	// it when the restart loop exhausts XportCfg.MaxRestartAttempts, and
+	// it never leaves this state on its own.  All Tx/session-open
+	// waiters are unblocked with an error as soon as this state is
+	// entered.
+	BLE_XPORT_STATE_FAILED
 )
 
 // Implements xport.Xport.
@@ -65,14 +93,45 @@ type BleXport struct {
 	shutdownChan     chan bool
 	numStopListeners int
 
+	// Protects lastErr and stateChangeCh below.  bx.state itself is read
+	// and written atomically so that getState() stays lock-free.
+	stateMtx      sync.Mutex
+	stateChangeCh chan struct{}
+	lastErr       error
+
+	// Whether a restart is expected to follow the current STOPPING/STOPPED
+	// state.  Used by waitForStarted to tell "mid-restart, keep waiting"
+	// apart from "stopped for good, stop waiting" (explicit Stop(), or
+	// BlehostdRestart disabled).  Guarded by stateMtx.
+	willRestart bool
+
+	// Arbitrates access to the single-controller host's master role
+	// (connect / scan / discover) across concurrently open sessions.
+	master *MasterResource
+
+	// The authoritative host <-> controller sync tracker for the current
+	// run.  Re-created on every startOnce.
+	sync *syncTracker
+
+	// Registered XportObserver callbacks and the counters backing
+	// Stats(); see ble_observer.go.  observers is guarded by observerMtx;
+	// counters is accessed exclusively via sync/atomic; startedAt is
+	// guarded by stateMtx.
+	observerMtx sync.Mutex
+	observers   []XportObserver
+	counters    xportCounters
+	startedAt   time.Time
+
 	cfg XportCfg
 }
 
 func NewBleXport(cfg XportCfg) (*BleXport, error) {
 	bx := &BleXport{
-		Bd:           NewBleDispatcher(),
-		shutdownChan: make(chan bool),
-		cfg:          cfg,
+		Bd:            NewBleDispatcher(),
+		shutdownChan:  make(chan bool),
+		stateChangeCh: make(chan struct{}),
+		master:        NewMasterResource(),
+		cfg:           cfg,
 	}
 
 	return bx, nil
@@ -91,6 +150,14 @@ func (bx *BleXport) createUnixChild() {
 	bx.client = unixchild.New(config)
 }
 
+// WaitUntilStarted blocks until the transport is ready to initiate
+// connections.  BlePlainSesn and BleOicSesn call this at the start of their
+// Open() implementations so that a session open rides out a blehostd
+// restart instead of racing it.  A zero deadline means wait forever.
+func (bx *BleXport) WaitUntilStarted(deadline time.Time) error {
+	return bx.waitForStarted(deadline)
+}
+
 func (bx *BleXport) BuildSesn(cfg sesn.SesnCfg) (sesn.Sesn, error) {
 	switch cfg.MgmtProto {
 	case sesn.MGMT_PROTO_NMP:
@@ -104,85 +171,13 @@ func (bx *BleXport) BuildSesn(cfg sesn.SesnCfg) (sesn.Sesn, error) {
 	}
 }
 
-func (bx *BleXport) addSyncListener() (*BleListener, error) {
-	bl := NewBleListener()
-	base := BleMsgBase{
-		Op:         MSG_OP_EVT,
-		Type:       MSG_TYPE_SYNC_EVT,
-		Seq:        -1,
-		ConnHandle: -1,
-	}
-	if err := bx.Bd.AddListener(base, bl); err != nil {
-		return nil, err
-	}
-
-	return bl, nil
-}
-
-func (bx *BleXport) removeSyncListener() {
-	base := BleMsgBase{
-		Op:         MSG_OP_EVT,
-		Type:       MSG_TYPE_SYNC_EVT,
-		Seq:        -1,
-		ConnHandle: -1,
-	}
-	bx.Bd.RemoveListener(base)
-}
-
-func (bx *BleXport) querySyncStatus() (bool, error) {
-	req := &BleSyncReq{
-		Op:   MSG_OP_REQ,
-		Type: MSG_TYPE_SYNC,
-		Seq:  NextSeq(),
-	}
-
-	j, err := json.Marshal(req)
-	if err != nil {
-		return false, err
-	}
-
-	bl := NewBleListener()
-	base := BleMsgBase{
-		Op:         -1,
-		Type:       -1,
-		Seq:        req.Seq,
-		ConnHandle: -1,
-	}
-	if err := bx.Bd.AddListener(base, bl); err != nil {
-		return false, err
-	}
-	defer bx.Bd.RemoveListener(base)
-
-	bx.txNoSync(j)
-	for {
-		select {
-		case err := <-bl.ErrChan:
-			return false, err
-		case bm := <-bl.BleChan:
-			switch msg := bm.(type) {
-			case *BleSyncRsp:
-				return msg.Synced, nil
-			}
-		}
-	}
-}
-
-func (bx *BleXport) initialSyncCheck() (bool, *BleListener, error) {
-	bl, err := bx.addSyncListener()
-	if err != nil {
-		return false, nil, err
-	}
-
-	synced, err := bx.querySyncStatus()
+func (bx *BleXport) shutdown(restart bool, err error) {
 	if err != nil {
-		bx.removeSyncListener()
-		return false, nil, err
+		bx.stateMtx.Lock()
+		bx.lastErr = err
+		bx.stateMtx.Unlock()
 	}
 
-	return synced, bl, nil
-}
-
-func (bx *BleXport) shutdown(restart bool, err error) {
 	var fullyStarted bool
 
 	if bx.setStateFrom(BLE_XPORT_STATE_STARTED,
@@ -198,6 +193,13 @@ func (bx *BleXport) shutdown(restart bool, err error) {
 		return
 	}
 
+	// Record whether a waiter in waitForStarted should expect this
+	// shutdown to be followed by a restart attempt, so it knows whether to
+	// keep waiting or fail fast.
+	bx.stateMtx.Lock()
+	bx.willRestart = restart && bx.cfg.BlehostdRestart
+	bx.stateMtx.Unlock()
+
 	// Stop the unixchild instance (blehostd + socket).
 	if bx.client != nil {
 		bx.client.Stop()
@@ -225,8 +227,21 @@ func (bx *BleXport) shutdown(restart bool, err error) {
 }
 
 func (bx *BleXport) setStateFrom(from BleXportState, to BleXportState) bool {
-	return atomic.CompareAndSwapUint32(
-		(*uint32)(&bx.state), uint32(from), uint32(to))
+	if !atomic.CompareAndSwapUint32(
+		(*uint32)(&bx.state), uint32(from), uint32(to)) {
+
+		return false
+	}
+
+	if to == BLE_XPORT_STATE_STARTED {
+		bx.stateMtx.Lock()
+		bx.startedAt = time.Now()
+		bx.stateMtx.Unlock()
+	}
+
+	bx.broadcastStateChange()
+	bx.notifyStateChange(from, to)
+	return true
 }
 
 func (bx *BleXport) getState() BleXportState {
@@ -234,6 +249,87 @@ func (bx *BleXport) getState() BleXportState {
 	return BleXportState(u32)
 }
 
+// broadcastStateChange wakes up every goroutine currently blocked in
+// waitForStarted().  It implements a broadcast-style condition variable on
+// top of a channel so that waiters can also select on a deadline.
+func (bx *BleXport) broadcastStateChange() {
+	bx.stateMtx.Lock()
+	ch := bx.stateChangeCh
+	bx.stateChangeCh = make(chan struct{})
+	bx.stateMtx.Unlock()
+
+	close(ch)
+}
+
+// fail forces the transport into the terminal failed state, regardless of
+// its current state, and unblocks all waiters with the given error.  It is
+// called by the restart loop once MaxRestartAttempts has been exhausted.
+func (bx *BleXport) fail(err error) {
+	from := bx.getState()
+
+	bx.stateMtx.Lock()
+	bx.lastErr = err
+	atomic.StoreUint32((*uint32)(&bx.state), uint32(BLE_XPORT_STATE_FAILED))
+	ch := bx.stateChangeCh
+	bx.stateChangeCh = make(chan struct{})
+	bx.stateMtx.Unlock()
+
+	close(ch)
+	bx.notifyStateChange(from, BLE_XPORT_STATE_FAILED)
+
+	log.Debugf("BLE transport permanently failed: %s", err.Error())
+}
+
+// waitForStarted blocks the calling goroutine until the transport reaches
+// BLE_XPORT_STATE_STARTED, the transport enters the terminal failed state,
+// or the given deadline elapses.  A zero deadline means wait forever.  This
+// allows Tx and session opens to ride out a blehostd restart instead of
+// failing the instant the transport goes down.
+func (bx *BleXport) waitForStarted(deadline time.Time) error {
+	for {
+		bx.stateMtx.Lock()
+		ch := bx.stateChangeCh
+		lastErr := bx.lastErr
+		bx.stateMtx.Unlock()
+
+		switch bx.getState() {
+		case BLE_XPORT_STATE_STARTED:
+			return nil
+		case BLE_XPORT_STATE_FAILED:
+			if lastErr != nil {
+				return lastErr
+			}
+			return nmxutil.NewXportError("BLE transport permanently down")
+		case BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STOPPING:
+			bx.stateMtx.Lock()
+			willRestart := bx.willRestart
+			bx.stateMtx.Unlock()
+
+			if !willRestart {
+				return nmxutil.NewXportError(
+					"BLE transport stopped; no restart in progress")
+			}
+		}
+
+		var timeoutChan <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nmxutil.NewXportError(
+					"Timeout waiting for BLE transport to restart")
+			}
+			timeoutChan = time.After(d)
+		}
+
+		select {
+		case <-ch:
+		case <-timeoutChan:
+			return nmxutil.NewXportError(
+				"Timeout waiting for BLE transport to restart")
+		}
+	}
+}
+
 func (bx *BleXport) Stop() error {
 	bx.shutdown(false, nil)
 	return nil
@@ -248,6 +344,11 @@ func (bx *BleXport) startOnce() error {
 	bx.numStopListeners = 0
 	bx.Bd.Clear()
 
+	// Drop any queued or held master-resource waiters left over from the
+	// previous run; they no longer correspond to a valid connection.
+	bx.master.reset(nmxutil.NewXportError(
+		"BLE transport restarted; master resource reset"))
+
 	bx.createUnixChild()
 	if err := bx.client.Start(); err != nil {
 		if unixchild.IsUcAcceptError(err) {
@@ -283,8 +384,11 @@ func (bx *BleXport) startOnce() error {
 		for {
 			select {
 			case buf := <-bx.client.FromChild:
-				if len(buf) != 0 {
+				if len(buf) == 0 {
+					bx.notifyDispatchDrop("empty buffer from blehostd")
+				} else {
 					log.Debugf("Receive from blehostd:\n%s", hex.Dump(buf))
+					bx.notifyRx(len(buf))
 					bx.Bd.Dispatch(buf)
 				}
 
@@ -294,62 +398,20 @@ func (bx *BleXport) startOnce() error {
 		}
 	}()
 
-	synced, bl, err := bx.initialSyncCheck()
-	if err != nil {
+	// Perform the initial sync check, then hand off to the sync tracker for
+	// the lifetime of this run: it listens for sync-lost events and, if
+	// configured, polls blehostd on a timer as a backstop.
+	bx.sync = newSyncTracker(bx)
+	if err := bx.sync.start(); err != nil {
 		bx.shutdown(true, err)
 		return err
 	}
 
-	if !synced {
-		// Not synced yet.  Wait for sync event.
-
-	SyncLoop:
-		for {
-			select {
-			case err := <-bl.ErrChan:
-				bx.shutdown(true, err)
-				return err
-			case bm := <-bl.BleChan:
-				switch msg := bm.(type) {
-				case *BleSyncEvt:
-					if msg.Synced {
-						break SyncLoop
-					}
-				}
-			case <-time.After(bx.cfg.SyncTimeout):
-				err := nmxutil.NewXportError(
-					"Timeout waiting for host <-> controller sync")
-				bx.shutdown(true, err)
-				return err
-			}
-		}
-	}
-
-	// Host and controller are synced.  Listen for sync loss in the background.
-	go func() {
-		bx.numStopListeners++
-		for {
-			select {
-			case err := <-bl.ErrChan:
-				go bx.shutdown(true, err)
-			case bm := <-bl.BleChan:
-				switch msg := bm.(type) {
-				case *BleSyncEvt:
-					if !msg.Synced {
-						go bx.shutdown(true, nmxutil.NewXportError(
-							"BLE host <-> controller sync lost"))
-					}
-				}
-			case <-bx.stopChan:
-				return
-			}
-		}
-	}()
-
 	if !bx.setStateFrom(BLE_XPORT_STATE_STARTING, BLE_XPORT_STATE_STARTED) {
-		bx.shutdown(true, err)
-		return nmxutil.NewXportError(
+		err := nmxutil.NewXportError(
 			"Internal error; BLE transport in unexpected state")
+		bx.shutdown(true, err)
+		return err
 	}
 
 	return nil
@@ -361,6 +423,13 @@ func (bx *BleXport) Start() error {
 	if err := bx.startOnce(); err != nil {
 		log.Debugf("Error starting BLE transport: %s",
 			err.Error())
+
+		// No restart loop is going to run; make sure waitForStarted
+		// callers don't block waiting for one.
+		bx.stateMtx.Lock()
+		bx.willRestart = false
+		bx.stateMtx.Unlock()
+
 		return err
 	}
 
@@ -369,6 +438,10 @@ func (bx *BleXport) Start() error {
 	go func() {
 		// Block until transport shuts down.
 		restart := <-bx.shutdownChan
+
+		attempt := 0
+		backoff := bx.cfg.RestartBackoff
+
 		for {
 			// If restarts are disabled, or if the shutdown was a result of an
 			// explicit stop call (instead of an unexpected error), stop
@@ -377,9 +450,34 @@ func (bx *BleXport) Start() error {
 				break
 			}
 
-			// Wait a second before the next restart.  This is necessary to
-			// ensure the unix domain socket can be rebound.
-			time.Sleep(time.Second)
+			attempt++
+			if bx.cfg.MaxRestartAttempts > 0 &&
+				attempt > bx.cfg.MaxRestartAttempts {
+
+				bx.fail(nmxutil.NewXportError(fmt.Sprintf(
+					"BLE transport permanently down; "+
+						"giving up after %d restart attempts",
+					attempt-1)))
+				return
+			}
+
+			bx.stateMtx.Lock()
+			lastErr := bx.lastErr
+			bx.stateMtx.Unlock()
+			bx.notifyRestart(attempt, lastErr)
+
+			// Wait before the next restart.  This is necessary to ensure the
+			// unix domain socket can be rebound, and backs off exponentially
+			// on repeated failures so a wedged controller doesn't spin the
+			// restart loop.
+			log.Debugf("Waiting %s before BLE transport restart attempt %d",
+				backoff, attempt)
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if bx.cfg.RestartBackoffMax > 0 && backoff > bx.cfg.RestartBackoffMax {
+				backoff = bx.cfg.RestartBackoffMax
+			}
 
 			// Attempt to start the transport again.
 			if err := bx.startOnce(); err != nil {
@@ -387,7 +485,10 @@ func (bx *BleXport) Start() error {
 				log.Debugf("Error starting BLE transport: %s",
 					err.Error())
 			} else {
-				// Success.  Block until the transport shuts down.
+				// Success.  Reset the backoff state and block until the
+				// transport shuts down again.
+				attempt = 0
+				backoff = bx.cfg.RestartBackoff
 				restart = <-bx.shutdownChan
 			}
 		}
@@ -398,14 +499,23 @@ func (bx *BleXport) Start() error {
 
 func (bx *BleXport) txNoSync(data []byte) {
 	log.Debugf("Tx to blehostd:\n%s", hex.Dump(data))
+	bx.notifyTx(len(data))
 	bx.client.ToChild <- data
 }
 
+// Tx transmits to blehostd, blocking indefinitely if the transport is
+// currently restarting.
 func (bx *BleXport) Tx(data []byte) error {
-	if bx.getState() != BLE_XPORT_STATE_STARTED {
-		return nmxutil.NewXportError(
-			fmt.Sprintf("Attempt to transmit before BLE xport fully started; "+
-				"state=%d", bx.getState()))
+	return bx.TxDeadline(data, time.Time{})
+}
+
+// TxDeadline transmits to blehostd.  If the transport isn't currently
+// started (e.g., blehostd is mid-restart), it blocks until the transport
+// comes back up, the transport fails permanently, or the given deadline
+// elapses.  A zero deadline means wait forever.
+func (bx *BleXport) TxDeadline(data []byte, deadline time.Time) error {
+	if err := bx.waitForStarted(deadline); err != nil {
+		return err
 	}
 
 	bx.txNoSync(data)
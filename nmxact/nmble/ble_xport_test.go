@@ -0,0 +1,112 @@
+package nmble
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestXport() *BleXport {
+	return &BleXport{
+		stateChangeCh: make(chan struct{}),
+	}
+}
+
+func TestWaitForStartedAlreadyStarted(t *testing.T) {
+	bx := newTestXport()
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+	bx.setStateFrom(BLE_XPORT_STATE_STARTING, BLE_XPORT_STATE_STARTED)
+
+	if err := bx.waitForStarted(time.Time{}); err != nil {
+		t.Fatalf("waitForStarted on an already-started transport returned an error: %s",
+			err.Error())
+	}
+}
+
+func TestWaitForStartedUnblocksOnRestart(t *testing.T) {
+	bx := newTestXport()
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+	bx.setStateFrom(BLE_XPORT_STATE_STARTING, BLE_XPORT_STATE_STARTED)
+
+	bx.stateMtx.Lock()
+	bx.willRestart = true
+	bx.stateMtx.Unlock()
+	bx.setStateFrom(BLE_XPORT_STATE_STARTED, BLE_XPORT_STATE_STOPPING)
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPING, BLE_XPORT_STATE_STOPPED)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bx.waitForStarted(time.Time{})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("waitForStarted returned before the restart completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+	bx.setStateFrom(BLE_XPORT_STATE_STARTING, BLE_XPORT_STATE_STARTED)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("waitForStarted returned an error after a successful restart: %s",
+				err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitForStarted never unblocked after the transport restarted")
+	}
+}
+
+func TestWaitForStartedFailsFastWithNoRestart(t *testing.T) {
+	bx := newTestXport()
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+	bx.setStateFrom(BLE_XPORT_STATE_STARTING, BLE_XPORT_STATE_STARTED)
+
+	// willRestart left false: an explicit Stop(), or a restart-disabled
+	// config, should fail waiters immediately rather than hang.
+	bx.setStateFrom(BLE_XPORT_STATE_STARTED, BLE_XPORT_STATE_STOPPING)
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPING, BLE_XPORT_STATE_STOPPED)
+
+	if err := bx.waitForStarted(time.Time{}); err == nil {
+		t.Fatal("waitForStarted succeeded on a stopped transport with no restart pending")
+	}
+}
+
+func TestWaitForStartedUnblocksOnFail(t *testing.T) {
+	bx := newTestXport()
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bx.waitForStarted(time.Time{})
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("waitForStarted returned before the transport reached a terminal state")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	failErr := contextErr("permanently down")
+	bx.fail(failErr)
+
+	select {
+	case err := <-done:
+		if err != failErr {
+			t.Fatalf("waitForStarted returned %v, want %v", err, failErr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waitForStarted never unblocked after fail()")
+	}
+}
+
+func TestWaitForStartedDeadlineExpires(t *testing.T) {
+	bx := newTestXport()
+	bx.setStateFrom(BLE_XPORT_STATE_STOPPED, BLE_XPORT_STATE_STARTING)
+
+	err := bx.waitForStarted(time.Now().Add(20 * time.Millisecond))
+	if err == nil {
+		t.Fatal("waitForStarted succeeded past its deadline with no state change")
+	}
+}